@@ -0,0 +1,40 @@
+package ansible
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration wraps time.Duration so that ModuleInput fields can accept either a
+// plain integer, interpreted as a number of seconds for backward compatibility
+// with Ansible playbooks written before this field took durations, or a
+// duration string such as "5m", "90s", or "1h30m".
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler, accepting either a JSON number
+// (seconds) or a duration string parseable by time.ParseDuration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var asNumber int64
+	if err := json.Unmarshal(data, &asNumber); err == nil {
+		*d = Duration(time.Duration(asNumber) * time.Second)
+		return nil
+	}
+
+	var asString string
+	if err := json.Unmarshal(data, &asString); err != nil {
+		return fmt.Errorf("timeout must be a number of seconds or a duration string: %s", err)
+	}
+
+	parsed, err := time.ParseDuration(asString)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %s", asString, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Duration returns d as a time.Duration.
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
@@ -0,0 +1,42 @@
+package ansible
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshalJSONSeconds(t *testing.T) {
+	var d Duration
+	if err := json.Unmarshal([]byte(`90`), &d); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d.Duration() != 90*time.Second {
+		t.Errorf("expected 90s, got %s", d.Duration())
+	}
+}
+
+func TestDurationUnmarshalJSONString(t *testing.T) {
+	cases := map[string]time.Duration{
+		`"5m"`:    5 * time.Minute,
+		`"90s"`:   90 * time.Second,
+		`"1h30m"`: 90 * time.Minute,
+	}
+	for input, expected := range cases {
+		var d Duration
+		if err := json.Unmarshal([]byte(input), &d); err != nil {
+			t.Fatalf("unexpected error for %s: %s", input, err)
+		}
+		if d.Duration() != expected {
+			t.Errorf("for %s, expected %s, got %s", input, expected, d.Duration())
+		}
+	}
+}
+
+func TestDurationUnmarshalJSONMalformed(t *testing.T) {
+	var d Duration
+	err := json.Unmarshal([]byte(`"not-a-duration"`), &d)
+	if err == nil {
+		t.Fatal("expected an error for malformed duration string")
+	}
+}
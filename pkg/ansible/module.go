@@ -1,42 +1,65 @@
 package ansible
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloudboss/wheelie/pkg/wheelie"
 )
 
 const (
-	statePresent = "present"
-	stateAbsent  = "absent"
-	statePurged  = "purged"
+	statePresent    = "present"
+	stateAbsent     = "absent"
+	statePurged     = "purged"
+	stateRolledBack = "rolled_back"
 )
 
 // ModuleInput is the input passed by Ansible in the module declaration.
 type ModuleInput struct {
-	Kubeconfig      string                 `json:"kubeconfig"`
-	Chart           string                 `json:"chart"`
-	ChartVersion    string                 `json:"chart_version"`
-	Values          map[string]interface{} `json:"values"`
-	NoHooks         bool                   `json:"no_hooks"`
-	NoCRDHook       bool                   `json:"no_crd_hook"`
-	Timeout         int64                  `json:"timeout"`
-	Release         string                 `json:"release"`
-	Namespace       string                 `json:"namespace"`
-	State           string                 `json:"state"`
-	TillerNamespace string                 `json:"tiller_namespace"`
-	Wait            bool                   `json:"wait"`
+	Kubeconfig            string                 `json:"kubeconfig"`
+	Chart                 string                 `json:"chart"`
+	ChartVersion          string                 `json:"chart_version"`
+	HelmHome              string                 `json:"helm_home"`
+	Repo                  string                 `json:"repo"`
+	RepoURL               string                 `json:"repo_url"`
+	Username              string                 `json:"username"`
+	Password              string                 `json:"password"`
+	CAFile                string                 `json:"ca_file"`
+	InsecureSkipTLSVerify bool                   `json:"insecure_skip_tls_verify"`
+	Values                map[string]interface{} `json:"values"`
+	NoHooks               bool                   `json:"no_hooks"`
+	NoCRDHook             bool                   `json:"no_crd_hook"`
+	Timeout               Duration               `json:"timeout"`
+	Release               string                 `json:"release"`
+	Namespace             string                 `json:"namespace"`
+	State                 string                 `json:"state"`
+	TillerNamespace       string                 `json:"tiller_namespace"`
+	Wait                  bool                   `json:"wait"`
+	HelmVersion           string                 `json:"helm_version"`
+	Atomic                bool                   `json:"atomic"`
+	Revision              int32                  `json:"revision"`
+	CheckMode             bool                   `json:"check_mode"`
+	RunTests              bool                   `json:"run_tests"`
+	TestTimeout           Duration               `json:"test_timeout"`
 }
 
 // ModuleOutput is the output from the module to Ansible.
 type ModuleOutput struct {
-	Msg        string           `json:"msg,omitempty"`
-	Changed    bool             `json:"changed"`
-	Failed     bool             `json:"failed"`
-	Invocation ModuleInvocation `json:"invocation"`
+	Msg         string               `json:"msg,omitempty"`
+	Changed     bool                 `json:"changed"`
+	Failed      bool                 `json:"failed"`
+	Revision    int32                `json:"revision"`
+	Diff        string               `json:"diff,omitempty"`
+	DiffBefore  map[string]string    `json:"diff_before,omitempty"`
+	DiffAfter   map[string]string    `json:"diff_after,omitempty"`
+	TestResults []wheelie.TestResult `json:"test_results,omitempty"`
+	Invocation  ModuleInvocation     `json:"invocation"`
 }
 
 // ModuleInvocation shows the input to the module, which is included in the
@@ -76,18 +99,30 @@ func (m *HelmModule) Run() {
 	m.setDefaultInputs()
 
 	w := wheelie.Wheelie{
-		Kubeconfig:      m.Input.Kubeconfig,
-		Chart:           m.Input.Chart,
-		ChartVersion:    m.Input.ChartVersion,
-		Values:          m.Input.Values,
-		NoHooks:         m.Input.NoHooks,
-		NoCRDHook:       m.Input.NoCRDHook,
-		Timeout:         m.Input.Timeout,
-		Release:         m.Input.Release,
-		Namespace:       m.Input.Namespace,
-		Wait:            m.Input.Wait,
-		TillerNamespace: m.Input.TillerNamespace,
-		TillerTimeout:   300,
+		Kubeconfig:            m.Input.Kubeconfig,
+		Chart:                 m.Input.Chart,
+		ChartVersion:          m.Input.ChartVersion,
+		HelmHome:              m.Input.HelmHome,
+		Values:                m.Input.Values,
+		NoHooks:               m.Input.NoHooks,
+		NoCRDHook:             m.Input.NoCRDHook,
+		Timeout:               m.Input.Timeout.Duration(),
+		Release:               m.Input.Release,
+		Namespace:             m.Input.Namespace,
+		Wait:                  m.Input.Wait,
+		TillerNamespace:       m.Input.TillerNamespace,
+		TillerTimeout:         300 * time.Second,
+		HelmVersion:           m.Input.HelmVersion,
+		Atomic:                m.Input.Atomic,
+		Repo:                  m.Input.Repo,
+		RepoURL:               m.Input.RepoURL,
+		Username:              m.Input.Username,
+		Password:              m.Input.Password,
+		CAFile:                m.Input.CAFile,
+		InsecureSkipTLSVerify: m.Input.InsecureSkipTLSVerify,
+		CheckMode:             m.Input.CheckMode,
+		RunTests:              m.Input.RunTests,
+		TestTimeout:           m.Input.TestTimeout.Duration(),
 	}
 
 	err = w.ForwardTillerPort()
@@ -96,25 +131,48 @@ func (m *HelmModule) Run() {
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigCh)
+	go func() {
+		if _, ok := <-sigCh; ok {
+			cancel()
+		}
+	}()
+
 	var msg string
 	var changed bool
+	var revision int32
 
 	switch m.Input.State {
 	case statePresent:
-		msg, changed, err = w.EnsureReleasePresent()
+		msg, changed, revision, err = w.EnsureReleasePresent(ctx)
 	case stateAbsent:
-		msg, changed, err = w.EnsureReleaseAbsent()
+		msg, changed, revision, err = w.EnsureReleaseAbsent(ctx)
 	case statePurged:
-		msg, changed, err = w.EnsureReleasePurged()
+		msg, changed, revision, err = w.EnsureReleasePurged(ctx)
+	case stateRolledBack:
+		msg, changed, revision, err = w.EnsureReleaseRolledBack(ctx, m.Input.Revision)
 	default:
-		err = fmt.Errorf(`state must be one of '%s', '%s', or '%s'`,
-			statePresent, stateAbsent, statePurged)
+		err = fmt.Errorf(`state must be one of '%s', '%s', '%s', or '%s'`,
+			statePresent, stateAbsent, statePurged, stateRolledBack)
+	}
+	if w.TestResults != nil {
+		m.Output.TestResults = w.TestResults
 	}
 	if err != nil {
 		m.fail(err.Error())
 		return
 	}
-	m.succeed(msg, changed)
+	if w.Diff != nil {
+		m.Output.Diff = w.Diff.Diff
+		m.Output.DiffBefore = w.Diff.Before
+		m.Output.DiffAfter = w.Diff.After
+	}
+	m.succeed(msg, changed, revision)
 }
 
 func (m *HelmModule) setDefaultInputs() {
@@ -125,7 +183,10 @@ func (m *HelmModule) setDefaultInputs() {
 		m.Input.Namespace = "default"
 	}
 	if m.Input.Timeout == 0 {
-		m.Input.Timeout = 300
+		m.Input.Timeout = Duration(300 * time.Second)
+	}
+	if m.Input.TestTimeout == 0 {
+		m.Input.TestTimeout = Duration(300 * time.Second)
 	}
 	if m.Input.Values == nil {
 		m.Input.Values = make(map[string]interface{})
@@ -133,11 +194,15 @@ func (m *HelmModule) setDefaultInputs() {
 	if m.Input.TillerNamespace == "" {
 		m.Input.TillerNamespace = "kube-system"
 	}
+	if m.Input.HelmVersion == "" {
+		m.Input.HelmVersion = wheelie.HelmVersion3
+	}
 }
 
-func (m *HelmModule) succeed(msg string, changed bool) {
+func (m *HelmModule) succeed(msg string, changed bool, revision int32) {
 	m.Output.Msg = msg
 	m.Output.Changed = changed
+	m.Output.Revision = revision
 	m.respondJSON()
 }
 
@@ -0,0 +1,42 @@
+package wheelie
+
+import "context"
+
+const (
+	// HelmVersion2 selects the Tiller-based Helm 2 backend.
+	HelmVersion2 = "2"
+	// HelmVersion3 selects the Tiller-less Helm 3 backend.
+	HelmVersion3 = "3"
+)
+
+// Backend abstracts over the Helm 2 and Helm 3 client APIs so that Wheelie's
+// Ensure methods don't need to know which release manager is in use. Every
+// method returns the resulting release revision alongside the usual message,
+// changed flag, and error, so callers can track the deployed version. ctx is
+// honored where the underlying client API supports it (the Helm 3 install
+// and upgrade actions abort their Wait poll loop promptly on ctx.Done());
+// elsewhere the Helm client APIs used here offer no context-aware entry
+// point, so ctx is accepted for a uniform signature but cancellation of
+// those calls remains best-effort, handled by Wheelie.runCancellable.
+type Backend interface {
+	EnsureReleasePresent(ctx context.Context, w *Wheelie) (string, bool, int32, error)
+	EnsureReleaseAbsent(ctx context.Context, w *Wheelie) (string, bool, int32, error)
+	EnsureReleasePurged(ctx context.Context, w *Wheelie) (string, bool, int32, error)
+	EnsureReleaseRolledBack(ctx context.Context, w *Wheelie, revision int32) (string, bool, int32, error)
+
+	// CancelCleanup is called when an atomic EnsureReleasePresent is
+	// cancelled mid-flight. It makes a best-effort attempt to leave the
+	// release in a consistent state, rolling back to the previous revision
+	// if one exists or deleting the release if this was its first install,
+	// and returns a message describing what it did.
+	CancelCleanup(w *Wheelie) string
+}
+
+// backend selects the Backend implementation according to w.HelmVersion,
+// defaulting to the Helm 3 backend when unset.
+func (w *Wheelie) backend() Backend {
+	if w.HelmVersion == HelmVersion2 {
+		return &backendV2{}
+	}
+	return &backendV3{}
+}
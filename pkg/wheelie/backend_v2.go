@@ -0,0 +1,442 @@
+package wheelie
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/databus23/helm-diff/diff"
+	"github.com/databus23/helm-diff/manifest"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/helm"
+	"k8s.io/helm/pkg/proto/hapi/release"
+	storageerrors "k8s.io/helm/pkg/storage/errors"
+)
+
+// backendV2 manages releases through a Tiller server, using the Helm 2 client API.
+// ForwardTillerPort must be called (or TillerHost set) before any of its methods.
+type backendV2 struct{}
+
+// EnsureReleasePresent ensures a release is present according to the following rules:
+//
+// If the release is not found, it is installed.
+// If the release is found but in a deleted state, it is force updated.
+// If the release is otherwise present, a dry-run update is performed, and the output
+// is compared to the existing release.
+// If there are differences, the update is performed without dry-run set.
+//
+// The Helm 2 client API predates context support, so it offers no way to
+// abort an in-flight install/upgrade/Wait early; ctx is accepted only for a
+// uniform Backend signature and is not otherwise used here.
+func (b *backendV2) EnsureReleasePresent(ctx context.Context, w *Wheelie) (string, bool, int32, error) {
+	chartPath, err := w.resolveChart()
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	chart, err := chartutil.Load(chartPath)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	rawVals, err := json.Marshal(w.Values)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	client := b.client(w)
+
+	releaseResponse, err := client.ReleaseContent(w.Release)
+	if err != nil && strings.Contains(err.Error(), storageerrors.ErrReleaseNotFound(w.Release).Error()) {
+		// Release doesn't exist, will install
+		if w.CheckMode {
+			res, err := client.InstallReleaseFromChart(
+				chart,
+				w.Namespace,
+				helm.ValueOverrides(rawVals),
+				helm.ReleaseName(w.Release),
+				helm.InstallDisableHooks(w.NoHooks),
+				helm.InstallDisableCRDHook(w.NoCRDHook),
+				helm.InstallTimeout(timeoutSeconds(w.Timeout)),
+				helm.InstallDryRun(true))
+			if err != nil {
+				return "", false, 0, err
+			}
+			w.Diff = &ReleaseDiff{After: renderManifests(manifest.ParseRelease(res.Release))}
+			return "", true, 0, nil
+		}
+		res, err := client.InstallReleaseFromChart(
+			chart,
+			w.Namespace,
+			helm.ValueOverrides(rawVals),
+			helm.ReleaseName(w.Release),
+			helm.InstallDisableHooks(w.NoHooks),
+			helm.InstallDisableCRDHook(w.NoCRDHook),
+			helm.InstallTimeout(timeoutSeconds(w.Timeout)),
+			helm.InstallWait(w.Wait || w.Atomic))
+		if err != nil {
+			if w.Atomic {
+				return "", false, 0, b.recoverFailedInstall(client, w, err)
+			}
+			return "", false, 0, err
+		}
+		return b.afterApply(client, w, res.Release, true)
+	}
+	if releaseResponse.Release.Info.Status.Code == release.Status_DELETED {
+		// Release exists in deleted state, will force update
+		if w.CheckMode {
+			res, err := client.UpdateRelease(
+				w.Release,
+				chartPath,
+				helm.UpdateValueOverrides(rawVals),
+				helm.UpgradeDisableHooks(w.NoHooks),
+				helm.UpgradeTimeout(timeoutSeconds(w.Timeout)),
+				helm.UpgradeForce(true),
+				helm.UpgradeDryRun(true))
+			if err != nil {
+				return "", false, 0, err
+			}
+			w.Diff = &ReleaseDiff{After: renderManifests(manifest.ParseRelease(res.Release))}
+			return "", true, releaseResponse.Release.Version, nil
+		}
+		res, err := client.UpdateRelease(
+			w.Release,
+			chartPath,
+			helm.UpdateValueOverrides(rawVals),
+			helm.UpgradeDisableHooks(w.NoHooks),
+			helm.UpgradeTimeout(timeoutSeconds(w.Timeout)),
+			helm.UpgradeWait(w.Wait || w.Atomic),
+			helm.UpgradeForce(true))
+		if err != nil {
+			if w.Atomic {
+				return "", false, 0, b.recoverFailedUpgrade(client, w, err)
+			}
+			return "", false, 0, err
+		}
+		return b.afterApply(client, w, res.Release, false)
+	}
+
+	// Do a dry-run update to check the response for any differences between
+	// desired and actual state.
+	dryRunResponse, err := client.UpdateRelease(
+		w.Release,
+		chartPath,
+		helm.UpdateValueOverrides(rawVals),
+		helm.UpgradeDisableHooks(w.NoHooks),
+		helm.UpgradeTimeout(timeoutSeconds(w.Timeout)),
+		helm.UpgradeDryRun(true))
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	// Use helm-diff to check the difference between desired and actual state.
+	var currentManifests, newManifests map[string]*manifest.MappingResult
+
+	if w.NoHooks {
+		currentManifests = manifest.Parse(
+			releaseResponse.Release.Manifest, releaseResponse.Release.Namespace)
+		newManifests = manifest.Parse(
+			dryRunResponse.Release.Manifest, dryRunResponse.Release.Namespace)
+	} else {
+		currentManifests = manifest.ParseRelease(releaseResponse.Release)
+		newManifests = manifest.ParseRelease(dryRunResponse.Release)
+	}
+
+	var diffBuf bytes.Buffer
+	hasChanges := diff.DiffManifests(currentManifests, newManifests, []string{}, -1, &diffBuf)
+	w.Diff = &ReleaseDiff{
+		Before: renderManifests(currentManifests),
+		After:  renderManifests(newManifests),
+		Diff:   diffBuf.String(),
+	}
+
+	if w.CheckMode {
+		return "", hasChanges, releaseResponse.Release.Version, nil
+	}
+
+	if hasChanges {
+		res, err := client.UpdateRelease(
+			w.Release,
+			chartPath,
+			helm.UpdateValueOverrides(rawVals),
+			helm.UpgradeDisableHooks(w.NoHooks),
+			helm.UpgradeTimeout(timeoutSeconds(w.Timeout)),
+			helm.UpgradeWait(w.Wait || w.Atomic))
+		if err != nil {
+			if w.Atomic {
+				return "", false, 0, b.recoverFailedUpgrade(client, w, err)
+			}
+			return "", false, 0, err
+		}
+		return b.afterApply(client, w, res.Release, false)
+	}
+	return "", false, releaseResponse.Release.Version, nil
+}
+
+// afterApply optionally runs the chart's test hooks following a successful
+// install or upgrade. If RunTests is unset, it simply returns rel's
+// description, changed=true and its revision, matching the pre-existing
+// behavior. If a test fails and Atomic is set, the same rollback-or-delete
+// recovery as a failed install/upgrade is triggered.
+func (b *backendV2) afterApply(client *helm.Client, w *Wheelie, rel *release.Release, isInstall bool) (string, bool, int32, error) {
+	if !w.RunTests {
+		return rel.Info.Description, true, rel.Version, nil
+	}
+
+	results, passed, err := b.runTests(client, w)
+	w.TestResults = results
+	if err != nil {
+		return "", false, 0, fmt.Errorf("could not run release tests: %s", err)
+	}
+	if !passed {
+		testErr := fmt.Errorf("release tests failed:\n%s", testLog(results))
+		if w.Atomic {
+			if isInstall {
+				return "", false, 0, b.recoverFailedInstall(client, w, testErr)
+			}
+			return "", false, 0, b.recoverFailedUpgrade(client, w, testErr)
+		}
+		return "", false, 0, testErr
+	}
+	return rel.Info.Description, true, rel.Version, nil
+}
+
+// runTests runs the release's test hooks and collects their results. It
+// returns passed=false if any test reported a status other than SUCCESS;
+// RUNNING progress messages are recorded but do not count as failures.
+func (b *backendV2) runTests(client *helm.Client, w *Wheelie) ([]TestResult, bool, error) {
+	start := time.Now()
+	resCh, errCh := client.RunReleaseTest(w.Release, helm.ReleaseTestTimeout(timeoutSeconds(w.TestTimeout)))
+
+	var results []TestResult
+	passed := true
+	for resCh != nil || errCh != nil {
+		select {
+		case res, ok := <-resCh:
+			if !ok {
+				resCh = nil
+				continue
+			}
+			if res.Status != release.TestRun_SUCCESS && res.Status != release.TestRun_RUNNING {
+				passed = false
+			}
+			results = append(results, TestResult{
+				Name:     testHookName(res.Msg, w.Release),
+				Status:   res.Status.String(),
+				Info:     res.Msg,
+				Duration: time.Since(start),
+			})
+		case err, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			if err != nil {
+				return results, false, err
+			}
+		}
+	}
+	return results, passed, nil
+}
+
+// testHookName extracts the test hook's name from a TestReleaseResponse
+// message. Tiller's test runner emits messages of the form "<VERB>: <hook
+// name>" (e.g. "RUNNING: release-name-test-config", "SUCCESS: release-name-
+// test-config"); the Helm 2 API exposes no structured field for the hook
+// name, only this message, so it must be parsed out. If a message doesn't
+// match the expected form, fallback is returned instead.
+func testHookName(msg, fallback string) string {
+	if parts := strings.SplitN(msg, ": ", 2); len(parts) == 2 {
+		return parts[1]
+	}
+	return fallback
+}
+
+// testLog renders results as a newline-separated log for inclusion in an
+// error message when a release's tests fail.
+func testLog(results []TestResult) string {
+	var b strings.Builder
+	for _, r := range results {
+		fmt.Fprintf(&b, "[%s] %s: %s\n", r.Status, r.Name, r.Info)
+	}
+	return b.String()
+}
+
+// recoverFailedInstall is called when an atomic install fails. It deletes the
+// partially-applied release and folds the recovery outcome into the returned error
+// so that it surfaces in ModuleOutput.Msg alongside the original failure.
+func (b *backendV2) recoverFailedInstall(client *helm.Client, w *Wheelie, installErr error) error {
+	_, err := client.DeleteRelease(w.Release, helm.DeletePurge(true))
+	if err != nil {
+		return fmt.Errorf("install failed: %s; deleting the release also failed: %s", installErr, err)
+	}
+	return fmt.Errorf("install failed: %s; release was deleted", installErr)
+}
+
+// recoverFailedUpgrade is called when an atomic upgrade fails. It rolls the release
+// back to its previous successful revision (not merely the prior revision number,
+// which may itself be a FAILED release) and folds the recovery outcome into the
+// returned error so that it surfaces in ModuleOutput.Msg alongside the original
+// failure.
+func (b *backendV2) recoverFailedUpgrade(client *helm.Client, w *Wheelie, upgradeErr error) error {
+	content, err := client.ReleaseContent(w.Release)
+	if err != nil {
+		return fmt.Errorf("upgrade failed: %s; rollback also failed: could not fetch release: %s", upgradeErr, err)
+	}
+	prev, err := b.previousDeployedRevision(client, w.Release, content.Release.Version)
+	if err != nil {
+		return fmt.Errorf("upgrade failed: %s; rollback also failed: %s", upgradeErr, err)
+	}
+
+	_, err = client.RollbackRelease(
+		w.Release,
+		helm.RollbackVersion(prev),
+		helm.RollbackTimeout(timeoutSeconds(w.Timeout)),
+		helm.RollbackWait(true))
+	if err != nil {
+		return fmt.Errorf("upgrade failed: %s; rollback also failed: %s", upgradeErr, err)
+	}
+	return fmt.Errorf("upgrade failed: %s; release was rolled back to revision %d", upgradeErr, prev)
+}
+
+// EnsureReleaseAbsent deletes the helm release without the `DeletePurge` option set.
+func (b *backendV2) EnsureReleaseAbsent(ctx context.Context, w *Wheelie) (string, bool, int32, error) {
+	return b.ensureReleaseAbsent(w, false)
+}
+
+// EnsureReleasePurged deletes the helm release with the `DeletePurge` option set.
+func (b *backendV2) EnsureReleasePurged(ctx context.Context, w *Wheelie) (string, bool, int32, error) {
+	return b.ensureReleaseAbsent(w, true)
+}
+
+func (b *backendV2) ensureReleaseAbsent(w *Wheelie, purge bool) (string, bool, int32, error) {
+	client := b.client(w)
+
+	releaseResponse, err := client.ReleaseContent(w.Release)
+	if err != nil && strings.Contains(err.Error(), storageerrors.ErrReleaseNotFound(w.Release).Error()) {
+		return "", false, 0, nil
+	}
+	if releaseResponse.Release.Info.Status.Code == release.Status_DELETED && !purge {
+		return "", false, releaseResponse.Release.Version, nil
+	}
+
+	if w.CheckMode {
+		return "", true, releaseResponse.Release.Version, nil
+	}
+
+	opts := []helm.DeleteOption{
+		helm.DeleteDisableHooks(w.NoHooks),
+		helm.DeletePurge(purge),
+		helm.DeleteTimeout(timeoutSeconds(w.Timeout)),
+	}
+	res, err := client.DeleteRelease(w.Release, opts...)
+	if err != nil {
+		return "", false, 0, err
+	}
+	msg := fmt.Sprintf("release %v deleted", w.Release)
+	return msg, true, res.Release.Version, nil
+}
+
+// EnsureReleaseRolledBack rolls the release back to revision. When revision is 0,
+// the most recent DEPLOYED revision prior to the current one is used instead.
+func (b *backendV2) EnsureReleaseRolledBack(ctx context.Context, w *Wheelie, revision int32) (string, bool, int32, error) {
+	client := b.client(w)
+
+	if revision == 0 {
+		current, err := client.ReleaseContent(w.Release)
+		if err != nil {
+			return "", false, 0, fmt.Errorf("could not fetch current release for %q: %s", w.Release, err)
+		}
+		revision, err = b.previousDeployedRevision(client, w.Release, current.Release.Version)
+		if err != nil {
+			return "", false, 0, err
+		}
+	}
+
+	if w.CheckMode {
+		msg := fmt.Sprintf("release %v would be rolled back to revision %d", w.Release, revision)
+		return msg, true, revision, nil
+	}
+
+	res, err := client.RollbackRelease(
+		w.Release,
+		helm.RollbackVersion(revision),
+		helm.RollbackTimeout(timeoutSeconds(w.Timeout)),
+		helm.RollbackWait(w.Wait),
+		helm.RollbackDisableHooks(w.NoHooks))
+	if err != nil {
+		return "", false, 0, err
+	}
+	msg := fmt.Sprintf("release %v rolled back to revision %d", w.Release, revision)
+	return msg, true, res.Release.Version, nil
+}
+
+// previousDeployedRevision returns the most recent revision in the DEPLOYED state
+// for releaseName, excluding currentVersion.
+func (b *backendV2) previousDeployedRevision(client *helm.Client, releaseName string, currentVersion int32) (int32, error) {
+	history, err := client.ReleaseHistory(releaseName)
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch history for %q: %s", releaseName, err)
+	}
+
+	var best *release.Release
+	for _, r := range history.Releases {
+		if r.Info.Status.Code != release.Status_DEPLOYED || r.Version == currentVersion {
+			continue
+		}
+		if best == nil || r.Version > best.Version {
+			best = r
+		}
+	}
+	if best == nil {
+		return 0, fmt.Errorf("no previous deployed revision found for %q", releaseName)
+	}
+	return best.Version, nil
+}
+
+// CancelCleanup is called when an Ensure operation is cancelled mid-flight.
+// It makes a best-effort attempt to roll back to the previous revision, or
+// delete the release if this was its first install.
+func (b *backendV2) CancelCleanup(w *Wheelie) string {
+	client := b.client(w)
+
+	content, err := client.ReleaseContent(w.Release)
+	if err != nil {
+		return fmt.Sprintf("no cleanup performed: %s", err)
+	}
+
+	prev, err := b.previousDeployedRevision(client, w.Release, content.Release.Version)
+	if err == nil {
+		if _, rbErr := client.RollbackRelease(
+			w.Release,
+			helm.RollbackVersion(prev),
+			helm.RollbackTimeout(timeoutSeconds(w.Timeout))); rbErr != nil {
+			return fmt.Sprintf("rollback after cancellation failed: %s", rbErr)
+		}
+		return fmt.Sprintf("release was rolled back to revision %d after cancellation", prev)
+	}
+	if content.Release.Version != 1 {
+		return fmt.Sprintf("no cleanup performed: %s", err)
+	}
+
+	if _, delErr := client.DeleteRelease(w.Release, helm.DeletePurge(true)); delErr != nil {
+		return fmt.Sprintf("cleanup after cancellation failed: %s", delErr)
+	}
+	return "release was deleted after cancellation"
+}
+
+func (b *backendV2) client(w *Wheelie) *helm.Client {
+	return helm.NewClient(
+		helm.Host(w.TillerHost),
+		helm.ConnectTimeout(timeoutSeconds(w.TillerTimeout)),
+	)
+}
+
+// timeoutSeconds converts d to whole seconds for the Helm 2 client API, which
+// predates Go's adoption of time.Duration for timeout flags.
+func timeoutSeconds(d time.Duration) int64 {
+	return int64(d.Seconds())
+}
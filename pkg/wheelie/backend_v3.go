@@ -0,0 +1,387 @@
+package wheelie
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/databus23/helm-diff/diff"
+	"github.com/databus23/helm-diff/manifest"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	helmrelease "helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// backendV3 manages releases directly against the Kubernetes API, storing
+// release data as Secrets using the Helm 3 client API. It requires no Tiller.
+type backendV3 struct{}
+
+// EnsureReleasePresent ensures a release is present according to the following rules:
+//
+// If the release is not found, it is installed.
+// If the release is found but only as uninstalled history (kept around by an
+// earlier non-purging EnsureReleaseAbsent), it is installed as well, since
+// action.NewUpgrade has nothing deployed to upgrade from.
+// If the release is otherwise present, an upgrade is performed.
+//
+// ctx is passed into the install/upgrade actions' RunWithContext, so
+// cancelling it aborts that action's Wait poll loop promptly instead of
+// waiting out the full timeout.
+func (b *backendV3) EnsureReleasePresent(ctx context.Context, w *Wheelie) (string, bool, int32, error) {
+	cfg, err := b.configuration(w)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	chartPath, err := w.resolveChart()
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	chart, err := chartutil.Load(chartPath)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	get := action.NewGet(cfg)
+	current, err := get.Run(w.Release)
+	needsInstall := err == driver.ErrReleaseNotFound
+	if err != nil && !needsInstall {
+		return "", false, 0, err
+	}
+	if err == nil && current.Info.Status == helmrelease.StatusUninstalled {
+		// Uninstalled history kept by a prior non-purging EnsureReleaseAbsent;
+		// there is no deployed revision for action.NewUpgrade to work from.
+		needsInstall = true
+	}
+
+	if needsInstall {
+		install := action.NewInstall(cfg)
+		install.Namespace = w.Namespace
+		install.ReleaseName = w.Release
+		install.DisableHooks = w.NoHooks
+		install.SkipCRDs = w.NoCRDHook
+		install.Timeout = w.Timeout
+
+		if w.CheckMode {
+			install.DryRun = true
+			rel, err := install.RunWithContext(ctx, chart, w.Values)
+			if err != nil {
+				return "", false, 0, err
+			}
+			newManifests := manifest.Parse(rel.Manifest, rel.Namespace)
+			var diffBuf bytes.Buffer
+			diff.DiffManifests(map[string]*manifest.MappingResult{}, newManifests, []string{}, -1, &diffBuf)
+			w.Diff = &ReleaseDiff{
+				After: renderManifests(newManifests),
+				Diff:  diffBuf.String(),
+			}
+			return "", true, 0, nil
+		}
+
+		install.Wait = w.Wait || w.Atomic
+		rel, err := install.RunWithContext(ctx, chart, w.Values)
+		if err != nil {
+			if w.Atomic {
+				return "", false, 0, b.recoverFailedInstall(cfg, w, err)
+			}
+			return "", false, 0, err
+		}
+		return b.afterApply(cfg, w, rel, true)
+	}
+
+	upgrade := action.NewUpgrade(cfg)
+	upgrade.Namespace = w.Namespace
+	upgrade.DisableHooks = w.NoHooks
+	upgrade.Timeout = w.Timeout
+
+	if w.CheckMode {
+		upgrade.DryRun = true
+		rel, err := upgrade.RunWithContext(ctx, w.Release, chart, w.Values)
+		if err != nil {
+			return "", false, 0, err
+		}
+
+		currentManifests := manifest.Parse(current.Manifest, current.Namespace)
+		newManifests := manifest.Parse(rel.Manifest, rel.Namespace)
+
+		var diffBuf bytes.Buffer
+		hasChanges := diff.DiffManifests(currentManifests, newManifests, []string{}, -1, &diffBuf)
+		w.Diff = &ReleaseDiff{
+			Before: renderManifests(currentManifests),
+			After:  renderManifests(newManifests),
+			Diff:   diffBuf.String(),
+		}
+		return "", hasChanges, int32(current.Version), nil
+	}
+
+	upgrade.Wait = w.Wait || w.Atomic
+	rel, err := upgrade.RunWithContext(ctx, w.Release, chart, w.Values)
+	if err != nil {
+		if w.Atomic {
+			return "", false, 0, b.recoverFailedUpgrade(cfg, w, err)
+		}
+		return "", false, 0, err
+	}
+	return b.afterApply(cfg, w, rel, false)
+}
+
+// afterApply optionally runs the chart's test hooks following a successful
+// install or upgrade. If RunTests is unset, it simply returns rel's
+// description, changed=true and its revision, matching the pre-existing
+// behavior. If a test fails and Atomic is set, the same rollback-or-delete
+// recovery as a failed install/upgrade is triggered.
+func (b *backendV3) afterApply(cfg *action.Configuration, w *Wheelie, rel *helmrelease.Release, isInstall bool) (string, bool, int32, error) {
+	if !w.RunTests {
+		return rel.Info.Description, true, int32(rel.Version), nil
+	}
+
+	results, passed, err := b.runTests(cfg, w)
+	w.TestResults = results
+	if err != nil {
+		return "", false, 0, fmt.Errorf("could not run release tests: %s", err)
+	}
+	if !passed {
+		testErr := fmt.Errorf("release tests failed:\n%s", testLog(results))
+		if w.Atomic {
+			if isInstall {
+				return "", false, 0, b.recoverFailedInstall(cfg, w, testErr)
+			}
+			return "", false, 0, b.recoverFailedUpgrade(cfg, w, testErr)
+		}
+		return "", false, 0, testErr
+	}
+	return rel.Info.Description, true, int32(rel.Version), nil
+}
+
+// runTests runs the release's test hooks and collects their results. It
+// returns passed=false if any test hook did not complete successfully.
+func (b *backendV3) runTests(cfg *action.Configuration, w *Wheelie) ([]TestResult, bool, error) {
+	testing := action.NewReleaseTesting(cfg)
+	testing.Namespace = w.Namespace
+	testing.Timeout = w.TestTimeout
+
+	rel, err := testing.Run(w.Release)
+	if err != nil && rel == nil {
+		return nil, false, err
+	}
+
+	var results []TestResult
+	passed := true
+	for _, hook := range rel.Hooks {
+		if !isTestHook(hook) {
+			continue
+		}
+		status := string(hook.LastRun.Phase)
+		if hook.LastRun.Phase != helmrelease.HookPhaseSucceeded {
+			passed = false
+		}
+		results = append(results, TestResult{
+			Name:     hook.Name,
+			Status:   status,
+			Info:     status,
+			Duration: hook.LastRun.CompletedAt.Time.Sub(hook.LastRun.StartedAt.Time),
+		})
+	}
+	return results, passed, nil
+}
+
+// isTestHook reports whether hook is a chart test hook, as opposed to one of
+// the other lifecycle hooks (pre-install, post-upgrade, etc).
+func isTestHook(hook *helmrelease.Hook) bool {
+	for _, event := range hook.Events {
+		if event == helmrelease.HookTest {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverFailedInstall is called when an atomic install fails. It uninstalls the
+// partially-applied release and folds the recovery outcome into the returned error
+// so that it surfaces in ModuleOutput.Msg alongside the original failure.
+func (b *backendV3) recoverFailedInstall(cfg *action.Configuration, w *Wheelie, installErr error) error {
+	uninstall := action.NewUninstall(cfg)
+	uninstall.Timeout = w.Timeout
+	_, err := uninstall.Run(w.Release)
+	if err != nil {
+		return fmt.Errorf("install failed: %s; deleting the release also failed: %s", installErr, err)
+	}
+	return fmt.Errorf("install failed: %s; release was deleted", installErr)
+}
+
+// recoverFailedUpgrade is called when an atomic upgrade fails. It rolls the release
+// back to its previous successful revision (not merely the prior revision number,
+// which may itself be a FAILED release) and folds the recovery outcome into the
+// returned error so that it surfaces in ModuleOutput.Msg alongside the original
+// failure.
+func (b *backendV3) recoverFailedUpgrade(cfg *action.Configuration, w *Wheelie, upgradeErr error) error {
+	prev, err := b.previousDeployedRevision(cfg, w.Release)
+	if err != nil {
+		return fmt.Errorf("upgrade failed: %s; rollback also failed: %s", upgradeErr, err)
+	}
+
+	rollback := action.NewRollback(cfg)
+	rollback.Version = int(prev)
+	rollback.Timeout = w.Timeout
+	rollback.Wait = true
+	if err := rollback.Run(w.Release); err != nil {
+		return fmt.Errorf("upgrade failed: %s; rollback also failed: %s", upgradeErr, err)
+	}
+	return fmt.Errorf("upgrade failed: %s; release was rolled back to revision %d", upgradeErr, prev)
+}
+
+// EnsureReleaseAbsent uninstalls the release.
+func (b *backendV3) EnsureReleaseAbsent(ctx context.Context, w *Wheelie) (string, bool, int32, error) {
+	return b.ensureReleaseAbsent(w, false)
+}
+
+// EnsureReleasePurged uninstalls the release, keeping no history.
+func (b *backendV3) EnsureReleasePurged(ctx context.Context, w *Wheelie) (string, bool, int32, error) {
+	return b.ensureReleaseAbsent(w, true)
+}
+
+func (b *backendV3) ensureReleaseAbsent(w *Wheelie, purge bool) (string, bool, int32, error) {
+	cfg, err := b.configuration(w)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	get := action.NewGet(cfg)
+	existing, err := get.Run(w.Release)
+	if err == driver.ErrReleaseNotFound {
+		return "", false, 0, nil
+	} else if err != nil {
+		return "", false, 0, err
+	}
+
+	if w.CheckMode {
+		return "", true, int32(existing.Version), nil
+	}
+
+	uninstall := action.NewUninstall(cfg)
+	uninstall.DisableHooks = w.NoHooks
+	uninstall.Timeout = w.Timeout
+	uninstall.KeepHistory = !purge
+
+	_, err = uninstall.Run(w.Release)
+	if err != nil {
+		return "", false, 0, err
+	}
+	msg := fmt.Sprintf("release %v deleted", w.Release)
+	return msg, true, int32(existing.Version), nil
+}
+
+// EnsureReleaseRolledBack rolls the release back to revision. When revision is 0,
+// the most recent DEPLOYED revision prior to the current one is used instead.
+func (b *backendV3) EnsureReleaseRolledBack(ctx context.Context, w *Wheelie, revision int32) (string, bool, int32, error) {
+	cfg, err := b.configuration(w)
+	if err != nil {
+		return "", false, 0, err
+	}
+
+	if revision == 0 {
+		revision, err = b.previousDeployedRevision(cfg, w.Release)
+		if err != nil {
+			return "", false, 0, err
+		}
+	}
+
+	if w.CheckMode {
+		msg := fmt.Sprintf("release %v would be rolled back to revision %d", w.Release, revision)
+		return msg, true, revision, nil
+	}
+
+	rollback := action.NewRollback(cfg)
+	rollback.Version = int(revision)
+	rollback.Timeout = w.Timeout
+	rollback.Wait = w.Wait
+	rollback.DisableHooks = w.NoHooks
+
+	if err := rollback.Run(w.Release); err != nil {
+		return "", false, 0, err
+	}
+	msg := fmt.Sprintf("release %v rolled back to revision %d", w.Release, revision)
+	return msg, true, revision, nil
+}
+
+// previousDeployedRevision returns the most recent revision in the DEPLOYED state
+// for releaseName, excluding its current revision.
+func (b *backendV3) previousDeployedRevision(cfg *action.Configuration, releaseName string) (int32, error) {
+	history := action.NewHistory(cfg)
+	revisions, err := history.Run(releaseName)
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch history for %q: %s", releaseName, err)
+	}
+
+	current, err := action.NewGet(cfg).Run(releaseName)
+	if err != nil {
+		return 0, fmt.Errorf("could not fetch current release for %q: %s", releaseName, err)
+	}
+
+	var best *helmrelease.Release
+	for _, r := range revisions {
+		if r.Info.Status != helmrelease.StatusDeployed || r.Version == current.Version {
+			continue
+		}
+		if best == nil || r.Version > best.Version {
+			best = r
+		}
+	}
+	if best == nil {
+		return 0, fmt.Errorf("no previous deployed revision found for %q", releaseName)
+	}
+	return int32(best.Version), nil
+}
+
+// CancelCleanup is called when an Ensure operation is cancelled mid-flight.
+// It makes a best-effort attempt to roll back to the previous revision, or
+// uninstall the release if this was its first install.
+func (b *backendV3) CancelCleanup(w *Wheelie) string {
+	cfg, err := b.configuration(w)
+	if err != nil {
+		return fmt.Sprintf("no cleanup performed: %s", err)
+	}
+
+	current, err := action.NewGet(cfg).Run(w.Release)
+	if err != nil {
+		return fmt.Sprintf("no cleanup performed: %s", err)
+	}
+
+	prev, err := b.previousDeployedRevision(cfg, w.Release)
+	if err == nil {
+		rollback := action.NewRollback(cfg)
+		rollback.Version = int(prev)
+		if rbErr := rollback.Run(w.Release); rbErr != nil {
+			return fmt.Sprintf("rollback after cancellation failed: %s", rbErr)
+		}
+		return fmt.Sprintf("release was rolled back to revision %d after cancellation", prev)
+	}
+	if current.Version != 1 {
+		return fmt.Sprintf("no cleanup performed: %s", err)
+	}
+
+	uninstall := action.NewUninstall(cfg)
+	if _, unErr := uninstall.Run(w.Release); unErr != nil {
+		return fmt.Sprintf("cleanup after cancellation failed: %s", unErr)
+	}
+	return "release was deleted after cancellation"
+}
+
+// configuration builds a Helm 3 action.Configuration driven by the user's
+// kubeconfig rather than a Tiller host.
+func (b *backendV3) configuration(w *Wheelie) (*action.Configuration, error) {
+	settings := cli.New()
+	settings.KubeConfig = w.Kubeconfig
+	settings.KubeContext = w.KubeContext
+
+	cfg := new(action.Configuration)
+	err := cfg.Init(settings.RESTClientGetter(), w.Namespace, "secret", log.Printf)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize helm 3 configuration: %s", err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,142 @@
+package wheelie
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/registry"
+	"k8s.io/helm/pkg/downloader"
+	"k8s.io/helm/pkg/getter"
+	"k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/helm/helmpath"
+	"k8s.io/helm/pkg/repo"
+)
+
+// resolveChart locates the chart referenced by w.Chart and returns a local path
+// suitable for chartutil.Load. It supports three forms of w.Chart:
+//
+// A plain path to a chart already on disk, used as-is.
+// A "repo/chartname" reference, resolved against the repository named by w.Repo
+// (or fetched directly from w.RepoURL, for repositories not already added locally).
+// A direct "http(s)://…chart.tgz" or "oci://…" reference, downloaded directly.
+//
+// In the latter two cases the chart is downloaded to a temporary directory,
+// and the path to the downloaded archive is returned. w.ChartVersion selects
+// the version for a repo reference and is the tag for an untagged OCI
+// reference; a direct HTTP(S) URL is downloaded as given. No digest of the
+// downloaded chart is verified.
+func (w *Wheelie) resolveChart() (string, error) {
+	if _, err := os.Stat(w.Chart); err == nil {
+		return w.Chart, nil
+	}
+
+	destDir, err := ioutil.TempDir("", "wheelie-chart-")
+	if err != nil {
+		return "", fmt.Errorf("could not create temp dir for chart download: %s", err)
+	}
+
+	switch {
+	case strings.HasPrefix(w.Chart, "oci://"):
+		return w.pullOCIChart(destDir)
+	case strings.HasPrefix(w.Chart, "http://"), strings.HasPrefix(w.Chart, "https://"):
+		return w.downloadChartURL(w.Chart, destDir)
+	default:
+		return w.downloadRepoChart(destDir)
+	}
+}
+
+// downloadRepoChart fetches a "repo/chartname" reference. When w.RepoURL is
+// set, the repository's index is fetched directly without requiring `helm
+// repo add`; otherwise the reference is resolved against a repo already
+// configured in the user's helm home via the standard chart downloader.
+func (w *Wheelie) downloadRepoChart(destDir string) (string, error) {
+	settings := environment.EnvSettings{}
+	getterProviders := getter.All(settings)
+
+	if w.RepoURL != "" {
+		chartURL, err := repo.FindChartInAuthAndTLSRepoURL(
+			w.RepoURL, w.Username, w.Password, w.Chart, w.ChartVersion,
+			w.CAFile, "", "", w.InsecureSkipTLSVerify, getterProviders)
+		if err != nil {
+			return "", fmt.Errorf("could not resolve chart %q in repo %q: %s", w.Chart, w.RepoURL, err)
+		}
+		return w.downloadChartURL(chartURL, destDir)
+	}
+
+	chartRef := w.Chart
+	if w.Repo != "" && !strings.Contains(chartRef, "/") {
+		chartRef = fmt.Sprintf("%s/%s", w.Repo, chartRef)
+	}
+
+	home := w.HelmHome
+	if home == "" {
+		home = environment.DefaultHelmHome
+	}
+
+	dl := downloader.ChartDownloader{
+		Out:      os.Stderr,
+		Getters:  getterProviders,
+		Username: w.Username,
+		Password: w.Password,
+		HelmHome: helmpath.Home(home),
+	}
+	path, _, err := dl.DownloadTo(chartRef, w.ChartVersion, destDir)
+	if err != nil {
+		return "", fmt.Errorf("could not download chart %q: %s", chartRef, err)
+	}
+	return path, nil
+}
+
+// downloadChartURL downloads a chart archive directly from a URL.
+func (w *Wheelie) downloadChartURL(chartURL, destDir string) (string, error) {
+	g, err := getter.NewHTTPGetter(chartURL, w.CAFile, "", "")
+	if err != nil {
+		return "", fmt.Errorf("could not create getter for %q: %s", chartURL, err)
+	}
+
+	data, err := g.Get(chartURL)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch chart %q: %s", chartURL, err)
+	}
+
+	destFile := filepath.Join(destDir, filepath.Base(chartURL))
+	out, err := os.Create(destFile)
+	if err != nil {
+		return "", fmt.Errorf("could not create %q: %s", destFile, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, data); err != nil {
+		return "", fmt.Errorf("could not write %q: %s", destFile, err)
+	}
+	return destFile, nil
+}
+
+// pullOCIChart pulls a chart archive by reference from an OCI registry of the
+// form "oci://registry/namespace/chart:tag", using the Helm 3 registry client.
+func (w *Wheelie) pullOCIChart(destDir string) (string, error) {
+	client, err := registry.NewClient()
+	if err != nil {
+		return "", fmt.Errorf("could not create OCI registry client: %s", err)
+	}
+
+	ref := strings.TrimPrefix(w.Chart, "oci://")
+	if w.ChartVersion != "" && !strings.Contains(ref, ":") {
+		ref = fmt.Sprintf("%s:%s", ref, w.ChartVersion)
+	}
+
+	result, err := client.Pull(ref, registry.PullOptWithChart(true))
+	if err != nil {
+		return "", fmt.Errorf("could not pull %q: %s", ref, err)
+	}
+
+	destFile := filepath.Join(destDir, fmt.Sprintf("%s.tgz", filepath.Base(ref)))
+	if err := ioutil.WriteFile(destFile, result.Chart.Data, 0644); err != nil {
+		return "", fmt.Errorf("could not write %q: %s", destFile, err)
+	}
+	return destFile, nil
+}
@@ -0,0 +1,25 @@
+package wheelie
+
+import "github.com/databus23/helm-diff/manifest"
+
+// ReleaseDiff holds a structured diff produced by a dry-run update, so that
+// Ansible's `--check --diff` workflow can render it instead of the
+// human-readable diff that helm-diff normally writes to stderr.
+type ReleaseDiff struct {
+	// Before holds the current manifests, keyed by GVK+namespace+name.
+	Before map[string]string
+	// After holds the manifests that would result from applying the desired state.
+	After map[string]string
+	// Diff is the rendered unified diff between Before and After.
+	Diff string
+}
+
+// renderManifests flattens helm-diff's parsed manifests into a plain
+// map[string]string keyed by GVK+namespace+name, suitable for JSON output.
+func renderManifests(manifests map[string]*manifest.MappingResult) map[string]string {
+	rendered := make(map[string]string, len(manifests))
+	for key, result := range manifests {
+		rendered[key] = result.Content
+	}
+	return rendered
+}
@@ -0,0 +1,12 @@
+package wheelie
+
+import "time"
+
+// TestResult holds the outcome of a single chart test hook run by
+// RunReleaseTest, for surfacing in ModuleOutput.
+type TestResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Info     string        `json:"info"`
+	Duration time.Duration `json:"duration"`
+}
@@ -1,45 +1,84 @@
 package wheelie
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"os"
-	"strings"
+	"time"
 
-	"github.com/databus23/helm-diff/diff"
-	"github.com/databus23/helm-diff/manifest"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/helm/pkg/chartutil"
-	"k8s.io/helm/pkg/helm"
 	"k8s.io/helm/pkg/helm/portforwarder"
 	"k8s.io/helm/pkg/kube"
-	"k8s.io/helm/pkg/proto/hapi/release"
-	storageerrors "k8s.io/helm/pkg/storage/errors"
 )
 
 // Wheelie uses the helm API to ensure a release is present, absent, or purged.
 type Wheelie struct {
-	Kubeconfig      string                 `json:"kubeconfig"`
-	KubeContext     string                 `json:"kube_context"`
-	Chart           string                 `json:"chart"`
-	ChartVersion    string                 `json:"chart_version"`
-	Values          map[string]interface{} `json:"values"`
-	NoHooks         bool                   `json:"no_hooks"`
-	NoCRDHook       bool                   `json:"no_crd_hook"`
-	Timeout         int64                  `json:"timeout"`
-	Release         string                 `json:"release"`
-	Namespace       string                 `json:"namespace"`
-	Wait            bool                   `json:"wait"`
-	TillerNamespace string                 `json:"tiller_namespace"`
-	TillerHost      string                 `json:"tiller_host"`
-	TillerTimeout   int64                  `json:"tiller_timeout"`
+	Kubeconfig   string `json:"kubeconfig"`
+	KubeContext  string `json:"kube_context"`
+	Chart        string `json:"chart"`
+	ChartVersion string `json:"chart_version"`
+	// HelmHome is the helm home directory used to resolve a bare "repo/chartname"
+	// reference against the repositories already configured there (e.g. via
+	// `helm repo add`). Defaults to environment.DefaultHelmHome when empty.
+	HelmHome string `json:"helm_home"`
+	// Repo names a chart repository already configured in the user's helm
+	// home, used to resolve Chart when it is a bare chart name.
+	Repo string `json:"repo"`
+	// RepoURL is the URL of a chart repository to fetch from directly,
+	// without requiring it to be added to the user's helm home first.
+	RepoURL               string                 `json:"repo_url"`
+	Username              string                 `json:"username"`
+	Password              string                 `json:"password"`
+	CAFile                string                 `json:"ca_file"`
+	InsecureSkipTLSVerify bool                   `json:"insecure_skip_tls_verify"`
+	Values                map[string]interface{} `json:"values"`
+	NoHooks               bool                   `json:"no_hooks"`
+	NoCRDHook             bool                   `json:"no_crd_hook"`
+	Timeout               time.Duration          `json:"timeout"`
+	Release               string                 `json:"release"`
+	Namespace             string                 `json:"namespace"`
+	Wait                  bool                   `json:"wait"`
+	TillerNamespace       string                 `json:"tiller_namespace"`
+	TillerHost            string                 `json:"tiller_host"`
+	TillerTimeout         time.Duration          `json:"tiller_timeout"`
+	// Atomic makes install and upgrade all-or-nothing: it implies Wait, and on
+	// failure the release is automatically deleted (first install) or rolled
+	// back to its previous revision (upgrade).
+	Atomic bool `json:"atomic"`
+	// HelmVersion selects which Backend manages the release, either
+	// HelmVersion2 (Tiller) or HelmVersion3 (Tiller-less). Defaults to
+	// HelmVersion3 when empty.
+	HelmVersion string `json:"helm_version"`
+	// CheckMode stops EnsureReleasePresent after the dry-run step, reporting
+	// whether a change would occur without applying it, matching Ansible's
+	// `--check --diff` workflow.
+	CheckMode bool `json:"check_mode"`
+	// Diff is populated by EnsureReleasePresent with the structured diff from
+	// its dry-run step, for callers that want to surface it (e.g. in
+	// Ansible's --diff output). It is not part of the JSON input.
+	Diff *ReleaseDiff `json:"-"`
+	// RunTests runs the chart's test hooks after a successful install or
+	// upgrade in EnsureReleasePresent. If a test fails and Atomic is set,
+	// the same rollback-or-delete recovery as a failed install/upgrade is
+	// triggered.
+	RunTests bool `json:"run_tests"`
+	// TestTimeout bounds how long RunTests waits for the test hooks to finish.
+	TestTimeout time.Duration `json:"test_timeout"`
+	// TestResults is populated by EnsureReleasePresent when RunTests is set,
+	// for callers that want to surface per-test outcomes. It is not part of
+	// the JSON input.
+	TestResults []TestResult `json:"-"`
 }
 
 // ForwardTillerPort creates a tunnel from localhost to the tiller pod. This should be
 // called before any of the Ensure methods, unless the TillerHost field of the Wheelie
 // struct has already been set. Calling this method will set the struct's TillerHost
-// field to 127.0.0.1:<port>, where <port> is a selected local listen port.
+// field to 127.0.0.1:<port>, where <port> is a selected local listen port. It is a
+// no-op unless HelmVersion is HelmVersion2, since the Helm 3 backend does not use Tiller.
 func (w *Wheelie) ForwardTillerPort() error {
+	if w.HelmVersion != HelmVersion2 {
+		return nil
+	}
+
 	config, err := kube.GetConfig(w.KubeContext, w.Kubeconfig).ClientConfig()
 	if err != nil {
 		return fmt.Errorf("could not get Kubernetes config for context %q: %s",
@@ -64,135 +103,91 @@ func (w *Wheelie) ForwardTillerPort() error {
 // If the release is otherwise present, a dry-run update is performed, and the output
 // is compared to the existing release.
 // If there are differences, the update is performed without dry-run set.
-func (w *Wheelie) EnsureReleasePresent() (string, bool, error) {
-	chartPath := w.Chart
-
-	chart, err := chartutil.Load(chartPath)
-	if err != nil {
-		return "", false, err
-	}
-
-	rawVals, err := json.Marshal(w.Values)
-	if err != nil {
-		return "", false, err
-	}
-
-	helmOptions := []helm.Option{
-		helm.Host(w.TillerHost),
-		helm.ConnectTimeout(w.TillerTimeout),
-	}
-	client := helm.NewClient(helmOptions...)
-
-	releaseResponse, err := client.ReleaseContent(w.Release)
-	if err != nil && strings.Contains(err.Error(), storageerrors.ErrReleaseNotFound(w.Release).Error()) {
-		// Release doesn't exist, will install
-		res, err := client.InstallReleaseFromChart(
-			chart,
-			w.Namespace,
-			helm.ValueOverrides(rawVals),
-			helm.ReleaseName(w.Release),
-			helm.InstallDisableHooks(w.NoHooks),
-			helm.InstallDisableCRDHook(w.NoCRDHook),
-			helm.InstallTimeout(w.Timeout),
-			helm.InstallWait(w.Wait))
-		if err != nil {
-			return "", false, err
-		}
-		return res.Release.Info.Description, true, nil
-	}
-	if releaseResponse.Release.Info.Status.Code == release.Status_DELETED {
-		// Release exists in deleted state, will force update
-		res, err := client.UpdateRelease(
-			w.Release,
-			chartPath,
-			helm.UpdateValueOverrides(rawVals),
-			helm.UpgradeDisableHooks(w.NoHooks),
-			helm.UpgradeTimeout(w.Timeout),
-			helm.UpgradeWait(w.Wait),
-			helm.UpgradeForce(true))
-		if err != nil {
-			return "", false, err
-		}
-		return res.Release.Info.Description, true, nil
-	}
-
-	// Do a dry-run update to check the response for any differences between
-	// desired and actual state.
-	dryRunResponse, err := client.UpdateRelease(
-		w.Release,
-		chartPath,
-		helm.UpdateValueOverrides(rawVals),
-		helm.UpgradeDisableHooks(w.NoHooks),
-		helm.UpgradeTimeout(w.Timeout),
-		helm.UpgradeDryRun(true))
-	if err != nil {
-		return "", false, err
-	}
-
-	// Use helm-diff to check the difference between desired and actual state.
-	var currentManifests, newManifests map[string]*manifest.MappingResult
-
-	if w.NoHooks {
-		currentManifests = manifest.Parse(
-			releaseResponse.Release.Manifest, releaseResponse.Release.Namespace)
-		newManifests = manifest.Parse(
-			dryRunResponse.Release.Manifest, dryRunResponse.Release.Namespace)
-	} else {
-		currentManifests = manifest.ParseRelease(releaseResponse.Release)
-		newManifests = manifest.ParseRelease(dryRunResponse.Release)
-	}
-
-	hasChanges := diff.DiffManifests(currentManifests, newManifests, []string{}, -1, os.Stderr)
-	if hasChanges {
-		res, err := client.UpdateRelease(
-			w.Release,
-			chartPath,
-			helm.UpdateValueOverrides(rawVals),
-			helm.UpgradeDisableHooks(w.NoHooks),
-			helm.UpgradeTimeout(w.Timeout),
-			helm.UpgradeWait(w.Wait))
-		if err != nil {
-			return "", false, err
-		}
-		return res.Release.Info.Description, true, nil
-	}
-	return "", false, nil
+//
+// These rules are those of the Helm 2 backend. The Helm 3 backend installs when
+// the release is not found or exists only as uninstalled history, and otherwise
+// always upgrades, without a dry-run comparison.
+//
+// It returns the resulting release revision alongside the usual message, changed
+// flag, and error. If ctx is cancelled before the operation completes, the
+// Helm 3 backend's install/upgrade Wait loop aborts promptly (ctx is passed
+// into the underlying RunWithContext call); the Helm 2 backend offers no
+// context-aware equivalent, so cancellation there remains best-effort, only
+// taking effect once the in-flight call happens to return. Either way, when
+// Atomic is set and the operation doesn't complete, a best-effort cleanup is
+// attempted and a "cancelled" error is returned; cleanup is skipped when
+// CheckMode is set, since a dry run has nothing to clean up.
+func (w *Wheelie) EnsureReleasePresent(ctx context.Context) (string, bool, int32, error) {
+	return w.runCancellable(ctx, w.Atomic && !w.CheckMode, func() (string, bool, int32, error) {
+		return w.backend().EnsureReleasePresent(ctx, w)
+	})
 }
 
-// EnsureReleaseAbsent deletes the helm release without the `DeletePurge` option set.
-func (w *Wheelie) EnsureReleaseAbsent() (string, bool, error) {
-	return w.ensureReleaseAbsent(false)
+// EnsureReleaseAbsent deletes the helm release, keeping its history.
+func (w *Wheelie) EnsureReleaseAbsent(ctx context.Context) (string, bool, int32, error) {
+	return w.runCancellable(ctx, false, func() (string, bool, int32, error) {
+		return w.backend().EnsureReleaseAbsent(ctx, w)
+	})
 }
 
-// EnsureReleasePurged deletes the helm release with the `DeletePurge` option set.
-func (w *Wheelie) EnsureReleasePurged() (string, bool, error) {
-	return w.ensureReleaseAbsent(true)
+// EnsureReleasePurged deletes the helm release without keeping its history.
+func (w *Wheelie) EnsureReleasePurged(ctx context.Context) (string, bool, int32, error) {
+	return w.runCancellable(ctx, false, func() (string, bool, int32, error) {
+		return w.backend().EnsureReleasePurged(ctx, w)
+	})
 }
 
-func (w *Wheelie) ensureReleaseAbsent(purge bool) (string, bool, error) {
-	helmOptions := []helm.Option{
-		helm.Host(w.TillerHost),
-		helm.ConnectTimeout(w.TillerTimeout),
-	}
-	client := helm.NewClient(helmOptions...)
+// EnsureReleaseRolledBack rolls the release back to revision. When revision is 0,
+// the most recent DEPLOYED revision prior to the current one is used instead.
+func (w *Wheelie) EnsureReleaseRolledBack(ctx context.Context, revision int32) (string, bool, int32, error) {
+	return w.runCancellable(ctx, false, func() (string, bool, int32, error) {
+		return w.backend().EnsureReleaseRolledBack(ctx, w, revision)
+	})
+}
 
-	releaseResponse, err := client.ReleaseContent(w.Release)
-	if err != nil && strings.Contains(err.Error(), storageerrors.ErrReleaseNotFound(w.Release).Error()) {
-		return "", false, nil
-	}
-	if releaseResponse.Release.Info.Status.Code == release.Status_DELETED && !purge {
-		return "", false, nil
-	}
+// ensureResult carries the return values of an Ensure method across the
+// goroutine boundary in runCancellable.
+type ensureResult struct {
+	msg      string
+	changed  bool
+	revision int32
+	err      error
+}
 
-	opts := []helm.DeleteOption{
-		helm.DeleteDisableHooks(w.NoHooks),
-		helm.DeletePurge(purge),
-		helm.DeleteTimeout(w.Timeout),
-	}
-	_, err = client.DeleteRelease(w.Release, opts...)
-	if err != nil {
-		return "", false, err
+// runCancellable runs fn in a goroutine and races it against ctx. fn is expected to have been given ctx itself
+// (the Helm 3 backend honors it inside the Wait poll loop via
+// RunWithContext, shortening how long an in-flight install or upgrade
+// takes); the Helm 2 backend and Helm 3's non-install actions have no
+// context-aware entry point, so for those ctx.Done() firing first doesn't
+// stop fn's goroutine. When allowCleanup is false, runCancellable then
+// returns at once and reports the operation as cancelled while fn keeps
+// running in the background; when allowCleanup is true, it waits for fn to
+// return before running CancelCleanup.
+//
+// allowCleanup gates whether CancelCleanup runs at all: it should be true
+// only for an atomic EnsureReleasePresent outside CheckMode, since that is
+// the only operation for which leaving a half-applied release in place is
+// worse than rolling it back or deleting it. For the other Ensure methods,
+// and for EnsureReleasePresent when Atomic or CheckMode don't apply,
+// allowCleanup is false and a cancellation is reported without attempting
+// any cleanup.
+func (w *Wheelie) runCancellable(ctx context.Context, allowCleanup bool, fn func() (string, bool, int32, error)) (string, bool, int32, error) {
+	ch := make(chan ensureResult, 1)
+	go func() {
+		msg, changed, revision, err := fn()
+		ch <- ensureResult{msg, changed, revision, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		cancelErr := ctx.Err()
+		if !allowCleanup {
+			return "", false, 0, fmt.Errorf("cancelled: %s", cancelErr)
+		}
+		<-ch
+		cleanup := w.backend().CancelCleanup(w)
+		return "", false, 0, fmt.Errorf("cancelled: %s; %s", cancelErr, cleanup)
+	case r := <-ch:
+		return r.msg, r.changed, r.revision, r.err
 	}
-	msg := fmt.Sprintf("release %v deleted", w.Release)
-	return msg, true, nil
 }